@@ -0,0 +1,401 @@
+package dagstore
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/arc/v2"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/index"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// joinHashes/splitHashes pack a set of multihashes into a single
+// length-prefixed blob, so the top-level index can remember which
+// multihashes belong to a shard without re-deriving them from the shard's
+// (possibly already-destroyed) own index.
+func joinHashes(mhs [][]byte) []byte {
+	var out []byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, mh := range mhs {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(mh)))
+		out = append(out, lenBuf[:n]...)
+		out = append(out, mh...)
+	}
+	return out
+}
+
+func splitHashes(b []byte) [][]byte {
+	var out [][]byte
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		b = b[n:]
+		if uint64(len(b)) < l {
+			break
+		}
+		out = append(out, b[:l])
+		b = b[l:]
+	}
+	return out
+}
+
+// shardAccessorLRUSize bounds the number of shard accessors kept open at
+// once by the top-level blockstore, so that a long-running retrieval/Bitswap
+// process doesn't accumulate an unbounded number of open CARv2 files.
+const shardAccessorLRUSize = 128
+
+// mhIndexKey builds the datastore key under which the shard key owning a
+// given multihash is stored.
+func mhIndexKey(mh cid.Cid) datastore.Key {
+	return datastore.NewKey("mh-index").ChildString(mh.Hash().B58String())
+}
+
+// AllBlockstore is a read-only blockstore that resolves any CID sealed in
+// any shard registered with the dagstore, without the caller needing to
+// know which piece (shard) the block belongs to. It's used by retrieval and
+// Bitswap to serve arbitrary CIDs out of the sealed deals on a miner. A CID
+// is only found once its shard has been added to the top-level index by
+// indexShard; shards that were never indexed are not searched.
+type AllBlockstore struct {
+	ctx       context.Context
+	dagStore  *dagstore.DAGStore
+	mhIndex   datastore.Datastore
+	onFailure func(dagstore.ShardResult)
+
+	mu         sync.Mutex
+	cache      *arc.ARCCache[shard.Key, *refCountedAccessor]
+	shardOrder []shard.Key
+}
+
+// refCountedAccessor keeps a shard's accessor open for as long as either the
+// LRU cache or an in-flight read holds a reference to it. The accessor is
+// only closed once it has been evicted from the cache AND every outstanding
+// read has released its reference, so a concurrent Destroy can't yank the
+// accessor out from under a Get that's still in progress.
+type refCountedAccessor struct {
+	mu       sync.Mutex
+	once     sync.Once
+	accessor *dagstore.ShardAccessor
+	closeFn  func() error
+	refs     int
+	evicted  bool
+	drained  chan struct{}
+}
+
+func newRefCountedAccessor(accessor *dagstore.ShardAccessor) *refCountedAccessor {
+	rca := &refCountedAccessor{
+		accessor: accessor,
+		refs:     1,
+		drained:  make(chan struct{}),
+	}
+	rca.closeFn = accessor.Close
+	return rca
+}
+
+// release drops one reference to the accessor, closing it if it's already
+// been evicted from the cache and this was the last outstanding reference.
+func (rca *refCountedAccessor) release() {
+	rca.mu.Lock()
+	rca.refs--
+	done := rca.evicted && rca.refs <= 0
+	rca.mu.Unlock()
+	if done {
+		rca.closeOnce()
+	}
+}
+
+// markEvicted records that the cache no longer references this accessor,
+// closing it immediately if there are no outstanding reads in flight.
+func (rca *refCountedAccessor) markEvicted() {
+	rca.mu.Lock()
+	rca.evicted = true
+	done := rca.refs <= 0
+	rca.mu.Unlock()
+	if done {
+		rca.closeOnce()
+	}
+}
+
+func (rca *refCountedAccessor) closeOnce() {
+	rca.once.Do(func() {
+		if err := rca.closeFn(); err != nil {
+			log.Warnf("failed to close evicted shard accessor: %s", err)
+		}
+		close(rca.drained)
+	})
+}
+
+// NewAllBlockstore constructs an AllBlockstore. onFailure is called
+// synchronously, on the acquiring reader's goroutine, whenever acquiring a
+// shard to serve a read fails, so that a retrieval hitting an errored shard feeds the same
+// recovery path (e.g. ShardRecoverer) as a failed RegisterShard/LoadShard. A
+// nil onFailure is accepted for callers that don't need failure reporting,
+// such as tests.
+func NewAllBlockstore(ctx context.Context, dagStore *dagstore.DAGStore, mhIndex datastore.Datastore, onFailure func(dagstore.ShardResult)) (*AllBlockstore, error) {
+	if onFailure == nil {
+		onFailure = func(dagstore.ShardResult) {}
+	}
+	bs := &AllBlockstore{
+		ctx:       ctx,
+		dagStore:  dagStore,
+		mhIndex:   mhIndex,
+		onFailure: onFailure,
+	}
+
+	cache, err := arc.NewARC[shard.Key, *refCountedAccessor](shardAccessorLRUSize)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create shard accessor cache: %w", err)
+	}
+	cache.OnEvict(func(key shard.Key, rca *refCountedAccessor) {
+		rca.markEvicted()
+	})
+	bs.cache = cache
+
+	return bs, nil
+}
+
+// shardMHsKey tracks which multihashes belong to a shard, so that
+// unindexShard can remove exactly those entries from the top-level index
+// without re-reading the (possibly already-destroyed) shard's own index.
+func shardMHsKey(key shard.Key) datastore.Key {
+	return datastore.NewKey("shard-mhs").ChildString(key.String())
+}
+
+// indexShard records every multihash contained in the shard's CARv2 index
+// against its shard key, so that Has/Get/GetSize can find the owning shard
+// in O(1) instead of scanning every registered shard.
+func (b *AllBlockstore) indexShard(ctx context.Context, key shard.Key, idx index.Index) error {
+	var mhs [][]byte
+	err := idx.ForEach(func(mh cid.Cid) error {
+		if err := b.mhIndex.Put(mhIndexKey(mh), []byte(key.String())); err != nil {
+			return err
+		}
+		mhs = append(mhs, mh.Hash())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.mhIndex.Put(shardMHsKey(key), joinHashes(mhs)); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.shardOrder = append(b.shardOrder, key)
+	b.mu.Unlock()
+	return nil
+}
+
+// unindexShard removes every multihash belonging to key from the top-level
+// index, e.g. after the shard has been destroyed.
+func (b *AllBlockstore) unindexShard(ctx context.Context, key shard.Key) error {
+	raw, err := b.mhIndex.Get(shardMHsKey(key))
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, mh := range splitHashes(raw) {
+		c := cid.NewCidV1(cid.Raw, mh)
+		if err := b.mhIndex.Delete(mhIndexKey(c)); err != nil {
+			return err
+		}
+	}
+	if err := b.mhIndex.Delete(shardMHsKey(key)); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	for i, k := range b.shardOrder {
+		if k == key {
+			b.shardOrder = append(b.shardOrder[:i], b.shardOrder[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// evict drops a shard's cached accessor, if any, ahead of it being
+// destroyed, and returns a channel that's closed once the accessor has
+// actually been closed. Readers that already hold a reference finish using
+// it; the underlying accessor is only closed once the last reference is
+// released, so a caller that waits on the returned channel before deleting
+// the shard is guaranteed no in-flight accessor is left dangling.
+func (b *AllBlockstore) evict(key shard.Key) <-chan struct{} {
+	b.mu.Lock()
+	rca, ok := b.cache.Peek(key)
+	if ok {
+		b.cache.Remove(key)
+	}
+	b.mu.Unlock()
+
+	if !ok {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return rca.drained
+}
+
+func (b *AllBlockstore) shardKeyFor(c cid.Cid) (shard.Key, bool, error) {
+	val, err := b.mhIndex.Get(mhIndexKey(c))
+	if xerrors.Is(err, datastore.ErrNotFound) {
+		return shard.Key{}, false, nil
+	}
+	if err != nil {
+		return shard.Key{}, false, err
+	}
+	return shard.KeyFromString(string(val)), true, nil
+}
+
+// acquire returns the blockstore for the shard with the given key, reusing a cached
+// accessor when one is already open, along with a release func the caller
+// MUST call exactly once when it's done using the returned blockstore.
+func (b *AllBlockstore) acquire(ctx context.Context, key shard.Key) (bstore.Blockstore, func(), error) {
+	b.mu.Lock()
+	if rca, ok := b.cache.Get(key); ok {
+		rca.mu.Lock()
+		rca.refs++
+		rca.mu.Unlock()
+		b.mu.Unlock()
+
+		bs, err := rca.accessor.Blockstore()
+		if err != nil {
+			rca.release()
+			return nil, nil, err
+		}
+		return bs, rca.release, nil
+	}
+	b.mu.Unlock()
+
+	resch := make(chan dagstore.ShardResult, 1)
+	if err := b.dagStore.AcquireShard(ctx, key, resch, dagstore.AcquireOpts{}); err != nil {
+		res := dagstore.ShardResult{Key: key, Error: err}
+		b.onFailure(res)
+		return nil, nil, xerrors.Errorf("failed to acquire shard %s: %w", key, err)
+	}
+	var res dagstore.ShardResult
+	select {
+	case res = <-resch:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	if res.Error != nil {
+		b.onFailure(res)
+		return nil, nil, xerrors.Errorf("failed to acquire shard %s: %w", key, res.Error)
+	}
+
+	rca := newRefCountedAccessor(res.Accessor)
+	b.mu.Lock()
+	b.cache.Add(key, rca)
+	b.mu.Unlock()
+
+	bs, err := rca.accessor.Blockstore()
+	if err != nil {
+		rca.release()
+		return nil, nil, err
+	}
+	return bs, rca.release, nil
+}
+
+func (b *AllBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	key, ok, err := b.shardKeyFor(c)
+	if err != nil || !ok {
+		return false, err
+	}
+	bs, release, err := b.acquire(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	return bs.Has(c)
+}
+
+func (b *AllBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	key, ok, err := b.shardKeyFor(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, bstore.ErrNotFound
+	}
+	bs, release, err := b.acquire(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return bs.Get(c)
+}
+
+func (b *AllBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	key, ok, err := b.shardKeyFor(c)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, bstore.ErrNotFound
+	}
+	bs, release, err := b.acquire(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return bs.GetSize(c)
+}
+
+// AllKeysChan streams the CIDs of every block in every shard indexed into
+// the top-level blockstore by this AllBlockstore, in the order they were
+// indexed, oldest first. The shard order is kept in memory only, so shards
+// indexed before the process started are not streamed.
+func (b *AllBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+
+		b.mu.Lock()
+		keys := make([]shard.Key, len(b.shardOrder))
+		copy(keys, b.shardOrder)
+		b.mu.Unlock()
+
+		for _, key := range keys {
+			if ctx.Err() != nil {
+				return
+			}
+			b.streamShardKeys(ctx, key, out)
+		}
+	}()
+	return out, nil
+}
+
+// streamShardKeys acquires a single shard and forwards its keys to out,
+// releasing the shard's accessor before returning.
+func (b *AllBlockstore) streamShardKeys(ctx context.Context, key shard.Key, out chan<- cid.Cid) {
+	bs, release, err := b.acquire(ctx, key)
+	if err != nil {
+		log.Warnf("AllKeysChan: failed to acquire shard %s: %s", key, err)
+		return
+	}
+	defer release()
+
+	ch, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		log.Warnf("AllKeysChan: failed to list keys for shard %s: %s", key, err)
+		return
+	}
+	for c := range ch {
+		select {
+		case out <- c:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
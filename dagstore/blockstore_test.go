@@ -0,0 +1,88 @@
+package dagstore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+// TestEvictDrainsConcurrentReaders exercises the exact race the request
+// calls out: a shard being read concurrently with it being destroyed. The
+// evicted accessor must be closed exactly once, and only after every
+// in-flight reader has released its reference.
+func TestEvictDrainsConcurrentReaders(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	b, err := NewAllBlockstore(context.Background(), nil, ds, nil)
+	require.NoError(t, err)
+
+	key := shard.Key{}
+	const readers = 8
+
+	var closed int32
+	rca := &refCountedAccessor{
+		refs:    readers,
+		drained: make(chan struct{}),
+	}
+	rca.closeFn = func() error {
+		atomic.AddInt32(&closed, 1)
+		return nil
+	}
+
+	b.mu.Lock()
+	b.cache.Add(key, rca)
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			rca.release()
+		}()
+	}
+
+	// Destroy races with the readers above: it must not close the accessor
+	// until every one of them has released its reference.
+	drained := b.evict(key)
+
+	select {
+	case <-drained:
+		t.Fatal("accessor closed before all concurrent readers released their reference")
+	default:
+	}
+
+	wg.Wait()
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("accessor was never closed after all readers released their reference")
+	}
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&closed), "accessor must be closed exactly once")
+}
+
+// TestEvictOfUncachedShardIsImmediate verifies that destroying a shard that
+// was never read through the top-level blockstore doesn't block waiting for
+// a reference that will never arrive.
+func TestEvictOfUncachedShardIsImmediate(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	b, err := NewAllBlockstore(context.Background(), nil, ds, nil)
+	require.NoError(t, err)
+
+	drained := b.evict(shard.Key{})
+	select {
+	case <-drained:
+	default:
+		t.Fatal("evict of an uncached shard should return an already-closed channel")
+	}
+}
@@ -0,0 +1,262 @@
+package dagstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/dagstore/mount"
+	"github.com/filecoin-project/dagstore/shard"
+)
+
+var log = logging.Logger("dagstore-wrapper")
+
+// DagStoreWrapper hides the details of the underlying DAG store
+// implementation from the storage market, and translates from CIDs to
+// PieceCIDs (shard keys) when registering and acquiring shards.
+type DagStoreWrapper interface {
+	// RegisterShard registers a shard for the given piece CID backed by the
+	// CARv2 file at carPath. If eagerInit is true the shard's index is built
+	// immediately; otherwise it is built lazily on first acquire.
+	RegisterShard(ctx context.Context, pieceCid cid.Cid, carPath string, eagerInit bool, resch chan dagstore.ShardResult) error
+
+	// LoadShard acquires the shard for the given piece CID and returns a
+	// read-only blockstore over its contents.
+	LoadShard(ctx context.Context, pieceCid cid.Cid) (bstore.Blockstore, error)
+
+	// Close shuts down the dagstore.
+	Close() error
+
+	// Blockstore returns a unified, read-only view over every block in
+	// every registered shard, keyed by CID rather than piece CID.
+	Blockstore() *AllBlockstore
+
+	// DestroyShard removes a shard and its CARv2 index, first draining the
+	// accessor cached for it by the top-level blockstore, if any.
+	// dropTransient is ignored by Wrapper: the dagstore is asked to destroy
+	// the shard with empty DestroyOpts either way.
+	DestroyShard(ctx context.Context, pieceCid cid.Cid, dropTransient bool) error
+
+	// ListShards returns the piece CID of every shard currently registered
+	// with the dagstore.
+	ListShards(ctx context.Context) ([]cid.Cid, error)
+
+	// RecoverShard retries initialization of a shard that's in the errored
+	// state, e.g. after a transient failure during registration.
+	RecoverShard(ctx context.Context, pieceCid cid.Cid) error
+
+	// FailureCh returns a channel on which a result is published when a
+	// shard operation (registration, acquisition, recovery) completes with an
+	// error. Failures are dropped while the channel's buffer is full.
+	FailureCh() <-chan dagstore.ShardResult
+}
+
+// LotusAccessor abstracts away the parts of the miner's storage subsystem
+// that the dagstore needs in order to mount shards.
+type LotusAccessor interface {
+	FetchUnsealedPiece(ctx context.Context, pieceCid cid.Cid) (io.ReadCloser, error)
+	GetUnpaddedCARSize(ctx context.Context, pieceCid cid.Cid) (uint64, error)
+	IsUnsealed(ctx context.Context, pieceCid cid.Cid) (bool, error)
+}
+
+// failureChSize bounds how many unconsumed failures the wrapper will buffer
+// on FailureCh before newer failures are dropped (and logged).
+const failureChSize = 64
+
+// Wrapper is the default DagStoreWrapper implementation, backed by a real
+// *dagstore.DAGStore.
+type Wrapper struct {
+	dagStore *dagstore.DAGStore
+	mountApi LotusAccessor
+	allBs    *AllBlockstore
+
+	failureCh chan dagstore.ShardResult
+}
+
+var _ DagStoreWrapper = (*Wrapper)(nil)
+
+func NewDagStoreWrapper(dagStore *dagstore.DAGStore, mountApi LotusAccessor, mhIndex datastore.Datastore) (*Wrapper, error) {
+	w := &Wrapper{
+		dagStore:  dagStore,
+		mountApi:  mountApi,
+		failureCh: make(chan dagstore.ShardResult, failureChSize),
+	}
+
+	// The top-level blockstore serves retrievals directly against shards, so
+	// an acquire failure on that path (e.g. Has/Get/GetSize through Bitswap)
+	// needs to reach the same failure-publishing path as RegisterShard,
+	// LoadShard, and RecoverShard, or a shard that errors only ever gets
+	// retried when something happens to hit one of those other paths first.
+	allBs, err := NewAllBlockstore(context.Background(), dagStore, mhIndex, w.publishFailure)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create top-level blockstore: %w", err)
+	}
+	w.allBs = allBs
+
+	return w, nil
+}
+
+func (w *Wrapper) FailureCh() <-chan dagstore.ShardResult {
+	return w.failureCh
+}
+
+// publishFailure forwards a failed shard result to FailureCh without
+// blocking the caller; if the channel is full the failure is dropped (and
+// logged) rather than stalling shard registration.
+func (w *Wrapper) publishFailure(res dagstore.ShardResult) {
+	select {
+	case w.failureCh <- res:
+	default:
+		log.Warnf("dropping dagstore failure for shard %s: FailureCh is full", res.Key)
+	}
+}
+
+func (w *Wrapper) Blockstore() *AllBlockstore {
+	return w.allBs
+}
+
+func (w *Wrapper) RegisterShard(ctx context.Context, pieceCid cid.Cid, carPath string, eagerInit bool, resch chan dagstore.ShardResult) error {
+	key := shard.KeyFromCID(pieceCid)
+	opts := dagstore.RegisterOpts{
+		ExistingTransient:  carPath,
+		LazyInitialization: !eagerInit,
+	}
+
+	// Wrap the caller's result channel so that once registration completes
+	// we can add the shard's multihashes to the top-level index before
+	// forwarding the result on.
+	internalCh := make(chan dagstore.ShardResult, 1)
+	go func() {
+		res := <-internalCh
+		if res.Error == nil {
+			if idx, err := w.dagStore.GetIndex(key); err != nil {
+				log.Warnf("failed to get index for shard %s after registration: %s", key, err)
+			} else if err := w.allBs.indexShard(ctx, key, idx); err != nil {
+				log.Warnf("failed to index shard %s into top-level blockstore: %s", key, err)
+			}
+		} else {
+			w.publishFailure(res)
+		}
+		resch <- res
+	}()
+
+	return w.dagStore.RegisterShard(ctx, key, &mount.FSMount{Path: carPath}, internalCh, opts)
+}
+
+func (w *Wrapper) LoadShard(ctx context.Context, pieceCid cid.Cid) (bstore.Blockstore, error) {
+	key := shard.KeyFromCID(pieceCid)
+
+	resch := make(chan dagstore.ShardResult, 1)
+	if err := w.dagStore.AcquireShard(ctx, key, resch, dagstore.AcquireOpts{}); err != nil {
+		return nil, xerrors.Errorf("failed to schedule acquire shard for piece %s: %w", pieceCid, err)
+	}
+
+	var res dagstore.ShardResult
+	select {
+	case res = <-resch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Error != nil {
+		w.publishFailure(res)
+		return nil, xerrors.Errorf("failed to acquire shard for piece %s: %w", pieceCid, res.Error)
+	}
+
+	bs, err := res.Accessor.Blockstore()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load blockstore for piece %s: %w", pieceCid, err)
+	}
+	return bs, nil
+}
+
+func (w *Wrapper) Close() error {
+	return w.dagStore.Close()
+}
+
+// DestroyShard removes a shard from the dagstore. The accessor cached for the
+// shard by the top-level blockstore, if any, is drained before the shard and
+// its index are deleted, so reads through the top-level blockstore that
+// already hold it finish first. Accessors acquired through LoadShard are not
+// tracked and not drained. dropTransient is not used.
+func (w *Wrapper) DestroyShard(ctx context.Context, pieceCid cid.Cid, dropTransient bool) error {
+	key := shard.KeyFromCID(pieceCid)
+
+	// Evict the shard from the top-level blockstore's cache and wait for
+	// any reads that already hold a reference to finish and close it,
+	// before asking the dagstore to destroy the shard out from under them.
+	drained := w.allBs.evict(key)
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	resch := make(chan dagstore.ShardResult, 1)
+	opts := dagstore.DestroyOpts{}
+	if err := w.dagStore.DestroyShard(ctx, key, resch, opts); err != nil {
+		return xerrors.Errorf("failed to schedule destroy of shard %s: %w", key, err)
+	}
+
+	select {
+	case res := <-resch:
+		if res.Error != nil {
+			return xerrors.Errorf("failed to destroy shard %s: %w", key, res.Error)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := w.allBs.unindexShard(ctx, key); err != nil {
+		log.Warnf("failed to remove shard %s from top-level index: %s", key, err)
+	}
+
+	return nil
+}
+
+// RecoverShard retries initialization of a shard that's in the errored
+// state, e.g. after a transient failure during registration. A failed
+// recovery is republished on FailureCh so a caller retrying with backoff
+// (such as storageimpl's ShardRecoverer) sees the outcome the same way it
+// saw the original failure.
+func (w *Wrapper) RecoverShard(ctx context.Context, pieceCid cid.Cid) error {
+	key := shard.KeyFromCID(pieceCid)
+
+	resch := make(chan dagstore.ShardResult, 1)
+	if err := w.dagStore.RecoverShard(ctx, key, resch, dagstore.RecoverOpts{}); err != nil {
+		return xerrors.Errorf("failed to schedule recovery of shard %s: %w", key, err)
+	}
+
+	select {
+	case res := <-resch:
+		if res.Error != nil {
+			w.publishFailure(res)
+			return xerrors.Errorf("failed to recover shard %s: %w", key, res.Error)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// ListShards returns the piece CID of every shard currently registered with
+// the dagstore.
+func (w *Wrapper) ListShards(ctx context.Context) ([]cid.Cid, error) {
+	infos := w.dagStore.AllShardsInfo()
+	out := make([]cid.Cid, 0, len(infos))
+	for key := range infos {
+		c, err := cid.Decode(key.String())
+		if err != nil {
+			log.Warnf("failed to decode shard key %s as a CID: %s", key, err)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
@@ -0,0 +1,62 @@
+package storageimpl
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+)
+
+// ErrReadOnly is returned by every mutating method of the blockstore
+// returned by AllBlockstore. It's distinct from bstore.ErrNotFound so that
+// callers distinguishing "block is missing" from "write rejected" (e.g. to
+// decide whether to fall back to fetching the block elsewhere) don't
+// mistake a rejected write for a missing block.
+var ErrReadOnly = xerrors.New("dagstore-backed blockstore is read-only")
+
+// AllBlockstore adapts the dagstore's unified, cross-shard blockstore to the
+// standard go-ipfs-blockstore interface so that retrieval and Bitswap can
+// serve any CID sealed in any deal without needing to know its piece CID.
+func AllBlockstore(dagStore mktdagstore.DagStoreWrapper) bstore.Blockstore {
+	return &allBlockstore{dagStore.Blockstore()}
+}
+
+type allBlockstore struct {
+	bs *mktdagstore.AllBlockstore
+}
+
+var _ bstore.Blockstore = (*allBlockstore)(nil)
+
+func (a *allBlockstore) Has(c cid.Cid) (bool, error) {
+	return a.bs.Has(context.TODO(), c)
+}
+
+func (a *allBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	return a.bs.Get(context.TODO(), c)
+}
+
+func (a *allBlockstore) GetSize(c cid.Cid) (int, error) {
+	return a.bs.GetSize(context.TODO(), c)
+}
+
+func (a *allBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return a.bs.AllKeysChan(ctx)
+}
+
+func (a *allBlockstore) Put(blocks.Block) error {
+	return ErrReadOnly
+}
+
+func (a *allBlockstore) PutMany([]blocks.Block) error {
+	return ErrReadOnly
+}
+
+func (a *allBlockstore) DeleteBlock(cid.Cid) error {
+	return ErrReadOnly
+}
+
+func (a *allBlockstore) HashOnRead(bool) {}
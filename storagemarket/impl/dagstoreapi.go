@@ -0,0 +1,18 @@
+package storageimpl
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+)
+
+// DagstoreDestroyShard is the operator-facing entry point for manually
+// evicting a bad shard, meant to be wired up behind the storage miner's
+// API/CLI layer (e.g. a `DagstoreDestroyShard` RPC method and matching CLI
+// command). Unlike ShardReaper, it destroys the shard unconditionally,
+// without waiting for deal-expiry or orphan-sweep criteria to be met.
+func DagstoreDestroyShard(ctx context.Context, dagStore mktdagstore.DagStoreWrapper, pieceCid cid.Cid) error {
+	return dagStore.DestroyShard(ctx, pieceCid, true)
+}
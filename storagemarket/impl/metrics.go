@@ -0,0 +1,25 @@
+package storageimpl
+
+import (
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+var (
+	metricRecoverAttempts = stats.Int64("dagstore_recover_attempts_total", "number of times a dagstore shard recovery was attempted", stats.UnitDimensionless)
+	metricRecoverSuccess  = stats.Int64("dagstore_recover_success_total", "number of dagstore shard recoveries that succeeded", stats.UnitDimensionless)
+)
+
+// Views are the opencensus views for the metrics recorded by this package.
+// They're registered by the caller that sets up the provider's metrics
+// exporter.
+var Views = []*view.View{
+	{
+		Measure:     metricRecoverAttempts,
+		Aggregation: view.Count(),
+	},
+	{
+		Measure:     metricRecoverSuccess,
+		Aggregation: view.Count(),
+	},
+}
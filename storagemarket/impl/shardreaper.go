@@ -0,0 +1,134 @@
+package storageimpl
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// terminalDealStates are the states from which a deal will never be handed
+// off to (or remain in) the sealing subsystem, so its shard, if any, can be
+// safely destroyed.
+var terminalDealStates = map[storagemarket.StorageDealStatus]struct{}{
+	storagemarket.StorageDealError:   {},
+	storagemarket.StorageDealSlashed: {},
+	storagemarket.StorageDealExpired: {},
+}
+
+// reapSweepInterval is how often the periodic orphan sweep runs.
+const reapSweepInterval = time.Hour
+
+// ShardReaper removes dagstore shards that are no longer backed by an
+// active deal. Shard registration is one-way, so without the reaper a shard
+// would outlive a deal that is slashed, expires, or errors out.
+type ShardReaper struct {
+	providerAddr address.Address
+	dagStore     mktdagstore.DagStoreWrapper
+	sectorState  SectorStateAccessor
+
+	sweepInterval time.Duration
+}
+
+func NewShardReaper(maddr address.Address, dagStore mktdagstore.DagStoreWrapper, sectorState SectorStateAccessor) *ShardReaper {
+	return &ShardReaper{
+		providerAddr:  maddr,
+		dagStore:      dagStore,
+		sectorState:   sectorState,
+		sweepInterval: reapSweepInterval,
+	}
+}
+
+// HandleDealTransition is called by the deal FSM's notifier on every state
+// transition. Once a deal reaches one of terminalDealStates (error, slashed
+// or expired), its shard (if one was registered) is destroyed.
+func (r *ShardReaper) HandleDealTransition(ctx context.Context, deal storagemarket.MinerDeal) {
+	if deal.Ref == nil || deal.Ref.PieceCid == nil {
+		return
+	}
+	if _, terminal := terminalDealStates[deal.State]; !terminal {
+		return
+	}
+
+	if err := r.dagStore.DestroyShard(ctx, *deal.Ref.PieceCid, true); err != nil {
+		log.Warnf("failed to destroy shard for deal %s in terminal state %s: %s",
+			deal.ProposalCid, storagemarket.DealStates[deal.State], err)
+	}
+}
+
+// Run starts the periodic orphan sweep. It blocks until ctx is cancelled.
+func (r *ShardReaper) Run(ctx context.Context, activeDeals func() ([]storagemarket.MinerDeal, error)) {
+	ticker := time.NewTicker(r.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.sweep(ctx, activeDeals); err != nil {
+				log.Warnf("dagstore reaper sweep failed: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep lists every registered shard and destroys the ones that no longer
+// correspond to an active deal's sealed or sealing sector. A deal is only
+// treated as live if its sector still exists on chain: the deal store alone
+// can lag the chain (e.g. a terminated sector whose deal hasn't yet
+// transitioned to a terminal state), so each deal is cross-referenced
+// against StateSectorGetInfo before its shard is protected from the sweep.
+//
+// A lookup failure (RPC timeout, disconnect, context deadline) is NOT the
+// same as "sector doesn't exist", and must not be treated as one: only a nil
+// *SectorOnChainInfo with no error means the sector is confirmed gone. Any
+// other error aborts the sweep entirely, rather than risking destroying a
+// shard for a deal that's still fully active.
+func (r *ShardReaper) sweep(ctx context.Context, activeDeals func() ([]storagemarket.MinerDeal, error)) error {
+	deals, err := activeDeals()
+	if err != nil {
+		return xerrors.Errorf("failed to list active deals: %w", err)
+	}
+
+	live := make(map[cid.Cid]struct{}, len(deals))
+	for _, deal := range deals {
+		if deal.Ref == nil || deal.Ref.PieceCid == nil {
+			continue
+		}
+		secInfo, err := r.sectorState.StateSectorGetInfo(ctx, r.providerAddr, deal.SectorNumber, types.EmptyTSK)
+		if err != nil {
+			return xerrors.Errorf("failed to look up sector %d for deal %s: %w", deal.SectorNumber, deal.ProposalCid, err)
+		}
+		if secInfo == nil {
+			log.Infof("deal %s references sector %d which no longer exists on chain; treating its shard as orphaned",
+				deal.ProposalCid, deal.SectorNumber)
+			continue
+		}
+		live[*deal.Ref.PieceCid] = struct{}{}
+	}
+
+	shards, err := r.dagStore.ListShards(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to list registered shards: %w", err)
+	}
+
+	for _, pieceCid := range shards {
+		if _, ok := live[pieceCid]; ok {
+			continue
+		}
+		log.Infof("destroying orphaned shard for piece %s: no active deal references it", pieceCid)
+		if err := r.dagStore.DestroyShard(ctx, pieceCid, true); err != nil {
+			log.Warnf("failed to destroy orphaned shard for piece %s: %s", pieceCid, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package storageimpl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/filecoin-project/specs-storage/storage"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// erroringSectorState fails every StateSectorGetInfo call with a generic,
+// non-not-found error, simulating a transient chain-RPC blip (timeout,
+// disconnect, context deadline) rather than a confirmed-absent sector.
+type erroringSectorState struct{}
+
+func (erroringSectorState) StateSectorGetInfo(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) (*miner.SectorOnChainInfo, error) {
+	return nil, xerrors.New("rpc: context deadline exceeded")
+}
+
+func (erroringSectorState) StateSectorGetPieces(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) ([]SectorPiece, error) {
+	return nil, nil
+}
+
+func (erroringSectorState) IsUnsealed(context.Context, storage.SectorRef, storiface.UnpaddedByteIndex, abi.UnpaddedPieceSize) (bool, error) {
+	return true, nil
+}
+
+// reaperDagStore is a minimal DagStoreWrapper fake that reports a fixed set
+// of registered shards and records which ones get destroyed.
+type reaperDagStore struct {
+	shards    []cid.Cid
+	destroyed []cid.Cid
+}
+
+func (f *reaperDagStore) RegisterShard(context.Context, cid.Cid, string, bool, chan dagstore.ShardResult) error {
+	return nil
+}
+
+func (f *reaperDagStore) LoadShard(context.Context, cid.Cid) (bstore.Blockstore, error) {
+	return nil, xerrors.New("not implemented")
+}
+
+func (f *reaperDagStore) Close() error { return nil }
+
+func (f *reaperDagStore) Blockstore() *mktdagstore.AllBlockstore { return nil }
+
+func (f *reaperDagStore) DestroyShard(ctx context.Context, pieceCid cid.Cid, dropTransient bool) error {
+	f.destroyed = append(f.destroyed, pieceCid)
+	return nil
+}
+
+func (f *reaperDagStore) ListShards(context.Context) ([]cid.Cid, error) {
+	return f.shards, nil
+}
+
+func (f *reaperDagStore) RecoverShard(context.Context, cid.Cid) error { return nil }
+
+func (f *reaperDagStore) FailureCh() <-chan dagstore.ShardResult { return nil }
+
+var _ mktdagstore.DagStoreWrapper = (*reaperDagStore)(nil)
+
+func reaperPieceCid(t *testing.T, i int) cid.Cid {
+	mh, err := multihash.Sum([]byte{byte(i)}, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+// TestSweepAbortsOnTransientSectorLookupFailure exercises a sweep where
+// StateSectorGetInfo fails transiently for a deal that's still fully active.
+// The sweep must abort rather than treat the lookup failure as "sector
+// gone", and the deal's shard must survive.
+func TestSweepAbortsOnTransientSectorLookupFailure(t *testing.T) {
+	pieceCid := reaperPieceCid(t, 0)
+
+	deal := storagemarket.MinerDeal{
+		Ref:          &storagemarket.DataRef{PieceCid: &pieceCid},
+		SectorNumber: 5,
+	}
+
+	dagStore := &reaperDagStore{shards: []cid.Cid{pieceCid}}
+	r := NewShardReaper(address.TestAddress, dagStore, erroringSectorState{})
+
+	err := r.sweep(context.Background(), func() ([]storagemarket.MinerDeal, error) {
+		return []storagemarket.MinerDeal{deal}, nil
+	})
+
+	require.Error(t, err, "a transient sector lookup failure must abort the sweep")
+	require.Empty(t, dagStore.destroyed, "a live deal's shard must survive a transient lookup failure")
+}
@@ -0,0 +1,101 @@
+package storageimpl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/stats"
+
+	"github.com/filecoin-project/dagstore"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+)
+
+// maxRecoverAttempts is the default number of times the recoverer will
+// retry a shard that keeps failing, per process lifetime.
+const maxRecoverAttempts = 1
+
+// recoverBaseBackoff is the delay before the first retry. If maxAttempts is
+// raised above its default of 1, subsequent retries for the same shard back
+// off exponentially from here.
+const recoverBaseBackoff = 5 * time.Second
+
+// ShardRecoverer watches the dagstore's failure channel and retries
+// initialization of shards that land in ShardStateErrored. Without this,
+// registerShards logging a failure and moving on leaves that shard's
+// retrievals broken until the miner process is restarted.
+type ShardRecoverer struct {
+	dagStore    mktdagstore.DagStoreWrapper
+	maxAttempts int
+	baseBackoff time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func NewShardRecoverer(dagStore mktdagstore.DagStoreWrapper) *ShardRecoverer {
+	return &ShardRecoverer{
+		dagStore:    dagStore,
+		maxAttempts: maxRecoverAttempts,
+		baseBackoff: recoverBaseBackoff,
+		attempts:    make(map[string]int),
+	}
+}
+
+// Run consumes the dagstore's failure channel and attempts recovery for
+// each failed shard, until ctx is cancelled. It's intended to be started
+// once the startup shard migration has completed.
+func (r *ShardRecoverer) Run(ctx context.Context) {
+	failureCh := r.dagStore.FailureCh()
+	for {
+		select {
+		case res, ok := <-failureCh:
+			if !ok {
+				return
+			}
+			go r.handleFailure(ctx, res)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *ShardRecoverer) handleFailure(ctx context.Context, res dagstore.ShardResult) {
+	key := res.Key.String()
+
+	r.mu.Lock()
+	attempt := r.attempts[key]
+	if attempt >= r.maxAttempts {
+		r.mu.Unlock()
+		log.Warnf("shard %s has exceeded its max recovery attempts (%d); giving up until restart", key, r.maxAttempts)
+		return
+	}
+	r.attempts[key] = attempt + 1
+	r.mu.Unlock()
+
+	backoff := r.baseBackoff * time.Duration(int64(1)<<uint(attempt))
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+		return
+	}
+
+	pieceCid, err := cid.Decode(key)
+	if err != nil {
+		log.Errorf("failed to decode shard key %s as a piece CID: %s", key, err)
+		return
+	}
+
+	stats.Record(ctx, metricRecoverAttempts.M(1))
+	if err := r.dagStore.RecoverShard(ctx, pieceCid); err != nil {
+		log.Warnf("failed to recover shard %s (attempt %d/%d): %s", key, attempt+1, r.maxAttempts, err)
+		return
+	}
+	stats.Record(ctx, metricRecoverSuccess.M(1))
+
+	r.mu.Lock()
+	delete(r.attempts, key)
+	r.mu.Unlock()
+}
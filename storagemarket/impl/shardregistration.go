@@ -2,9 +2,11 @@ package storageimpl
 
 import (
 	"context"
-	"math"
+	"sync"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"golang.org/x/time/rate"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/dagstore"
@@ -21,13 +23,48 @@ import (
 	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerstates"
 )
 
-var shardRegKey = datastore.NewKey("shards-registered")
+// shardRegPrefix namespaces the per-deal migration progress keys, so a
+// crashed migration can resume mid-way instead of starting from scratch.
+// A deal's key is present once its shard has been successfully registered.
+var shardRegPrefix = datastore.NewKey("shards-registered")
+
+// MigrationConcurrency is the default number of goroutines that register
+// shards in parallel during the startup migration.
+const MigrationConcurrency = 8
+
+// sectorInfoRateLimit bounds how many deals per second the migration looks
+// up (each with one StateSectorGetInfo, StateSectorGetPieces and IsUnsealed
+// call), so it doesn't hammer the chain/sealing subsystems on miners with a
+// large number of deals.
+const sectorInfoRateLimit = 20
+
+// SectorPiece describes where a single piece lives within a sector, as
+// reported by the chain's sector piece manifest.
+type SectorPiece struct {
+	PieceCID cid.Cid
+	Offset   storiface.UnpaddedByteIndex
+	Size     abi.UnpaddedPieceSize
+}
 
 type SectorStateAccessor interface {
 	StateSectorGetInfo(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) (*miner.SectorOnChainInfo, error)
+	StateSectorGetPieces(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) ([]SectorPiece, error)
 	IsUnsealed(ctx context.Context, sector storage.SectorRef, offset storiface.UnpaddedByteIndex, size abi.UnpaddedPieceSize) (bool, error)
 }
 
+// MigrationProgress reports the state of an in-flight (or completed) shard
+// migration. It's surfaced through the storage miner API so operators can
+// monitor progress on miners with a large number of deals.
+type MigrationProgress struct {
+	Registered int
+	Failed     int
+	Remaining  int
+}
+
+// MigrationProgressFunc is called every time a deal finishes migrating
+// (successfully or not).
+type MigrationProgressFunc func(MigrationProgress)
+
 // ShardMigrator is used to register all deals that are in the sealing / sealed
 // state with the DAG store as shards.
 // It will only run once on startup, from that point forward deals will be
@@ -37,6 +74,10 @@ type ShardMigrator struct {
 	ds           datastore.Datastore
 	dagStore     mktdagstore.DagStoreWrapper
 	sectorState  SectorStateAccessor
+
+	concurrency int
+	limiter     *rate.Limiter
+	onProgress  MigrationProgressFunc
 }
 
 func NewShardMigrator(
@@ -50,111 +91,160 @@ func NewShardMigrator(
 		ds:           ds,
 		dagStore:     dagStore,
 		sectorState:  sectorState,
+		concurrency:  MigrationConcurrency,
+		limiter:      rate.NewLimiter(rate.Limit(sectorInfoRateLimit), 1),
 	}
 }
 
-func (r *ShardMigrator) registerShards(ctx context.Context, deals []storagemarket.MinerDeal) error {
-	// Check if all deals have already been registered as shards
-	has, err := r.ds.Has(shardRegKey)
-	if err != nil {
-		return xerrors.Errorf("failed to get shard registration status: %w", err)
-	}
-	if has {
-		// All deals have been registered as shards, bail out
-		return nil
-	}
+// WithProgressCallback sets a callback that's invoked after every deal
+// finishes migrating, reporting the migration's progress so far.
+func (r *ShardMigrator) WithProgressCallback(f MigrationProgressFunc) *ShardMigrator {
+	r.onProgress = f
+	return r
+}
+
+// dealRegKey is the datastore key under which a deal's migration is marked
+// complete, once its shard has been successfully registered.
+func dealRegKey(pieceCid string) datastore.Key {
+	return shardRegPrefix.ChildString(pieceCid)
+}
 
+func (r *ShardMigrator) registerShards(ctx context.Context, deals []storagemarket.MinerDeal) error {
 	inSealingSubsystem := make(map[fsm.StateKey]struct{}, len(providerstates.StatesKnownBySealingSubsystem))
 	for _, s := range providerstates.StatesKnownBySealingSubsystem {
 		inSealingSubsystem[s] = struct{}{}
 	}
 
-	// channel where results will be received, and channel where the total
-	// number of registered shards will be sent.
-	resch := make(chan dagstore.ShardResult, 32)
-	totalCh := make(chan int)
-
-	// Start making progress consuming results. We won't know how many to
-	// actually consume until we register all shards.
-	//
-	// If there are any problems registering shards, just log an error
-	go func() {
-		var total = math.MaxInt64
-		var res dagstore.ShardResult
-		for rcvd := 0; rcvd < total; {
-			select {
-			case total = <-totalCh:
-				// we now know the total number of registered shards
-				// nullify so that we no longer consume from it after closed.
-				close(totalCh)
-				totalCh = nil
-			case res = <-resch:
-				rcvd++
-				if res.Error != nil {
-					log.Warnf("dagstore migration: failed to register shard: %s", res.Error)
-				}
-			}
-		}
-	}()
-
-	// Filter for deals that are currently sealing.
-	// If the deal has not yet been handed off to the sealing subsystem, we
-	// don't need to call RegisterShard in this migration; RegisterShard will
-	// be called in the new code once the deal reaches the state where it's
-	// handed off to the sealing subsystem.
-	var registered int
+	// Filter for deals that have been handed off to the sealing subsystem
+	// and have not already been registered as shards in a previous
+	// (possibly interrupted) run of this migration.
+	todo := make([]storagemarket.MinerDeal, 0, len(deals))
 	for _, deal := range deals {
 		if deal.Ref.PieceCid == nil {
 			continue
 		}
-
-		// Filter for deals that have been handed off to the sealing subsystem
 		if _, ok := inSealingSubsystem[deal.State]; !ok {
 			continue
 		}
-
-		// Check if the deal is in an unsealed state
-		isUnsealed, err := r.isUnsealed(ctx, deal.SectorNumber)
+		done, err := r.ds.Has(dealRegKey(deal.Ref.PieceCid.String()))
 		if err != nil {
-			isUnsealed = false
-			log.Errorf("failed to get unsealed state of deal with piece CID %s: %s", deal.Ref.PieceCid, err)
+			return xerrors.Errorf("failed to get shard registration status for piece %s: %w", deal.Ref.PieceCid, err)
 		}
-
-		// Register the deal as a shard with the DAG store, initializing the
-		// index immediately if the deal is unsealed (if the deal is not
-		// unsealed it will be initialized "lazily" once it's unsealed during
-		// retrieval)
-		err = r.dagStore.RegisterShard(ctx, *deal.Ref.PieceCid, deal.CARv2FilePath, isUnsealed, resch)
-		if err != nil {
-			log.Warnf("failed to register shard for deal with piece CID %s: %s", deal.Ref.PieceCid, err)
+		if done {
 			continue
 		}
-		registered++
+		todo = append(todo, deal)
+	}
+
+	var progress MigrationProgress
+	progress.Remaining = len(todo)
+	var mu sync.Mutex
+	r.reportProgress(progress)
+
+	dealCh := make(chan storagemarket.MinerDeal)
+	var wg sync.WaitGroup
+	for i := 0; i < r.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deal := range dealCh {
+				err := r.registerDeal(ctx, deal)
+
+				mu.Lock()
+				progress.Remaining--
+				if err != nil {
+					progress.Failed++
+					log.Warnf("failed to register shard for deal with piece CID %s: %s", deal.Ref.PieceCid, err)
+				} else {
+					progress.Registered++
+				}
+				snapshot := progress
+				mu.Unlock()
+
+				r.reportProgress(snapshot)
+			}
+		}()
+	}
+
+	for _, deal := range todo {
+		select {
+		case dealCh <- deal:
+		case <-ctx.Done():
+			close(dealCh)
+			wg.Wait()
+			return ctx.Err()
+		}
 	}
+	close(dealCh)
+	wg.Wait()
+
+	return nil
+}
 
-	totalCh <- registered
+// registerDeal rate-limits and performs the on-chain / sealing-subsystem
+// lookups needed to register a single deal's shard, then marks it done in
+// the datastore so a subsequent run of the migration can skip it.
+func (r *ShardMigrator) registerDeal(ctx context.Context, deal storagemarket.MinerDeal) error {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return err
+	}
 
-	// Completed registering all shards, so mark the migration as complete
-	err = r.ds.Put(shardRegKey, []byte{1})
+	isUnsealed, err := r.isUnsealed(ctx, deal)
 	if err != nil {
-		log.Errorf("failed to mark shards as registered: %s", err)
+		isUnsealed = false
+		log.Errorf("failed to get unsealed state of deal with piece CID %s: %s", deal.Ref.PieceCid, err)
 	}
 
-	err = r.ds.Sync(shardRegKey)
+	resch := make(chan dagstore.ShardResult, 1)
+	err = r.dagStore.RegisterShard(ctx, *deal.Ref.PieceCid, deal.CARv2FilePath, isUnsealed, resch)
 	if err != nil {
-		log.Errorf("failed to sync shards as registered: %s", err)
+		return xerrors.Errorf("failed to register shard: %w", err)
 	}
 
-	return nil
+	select {
+	case res := <-resch:
+		if res.Error != nil {
+			return xerrors.Errorf("failed to register shard: %w", res.Error)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	key := dealRegKey(deal.Ref.PieceCid.String())
+	if err := r.ds.Put(key, []byte{1}); err != nil {
+		return xerrors.Errorf("failed to mark shard as registered: %w", err)
+	}
+	return r.ds.Sync(key)
 }
 
-func (r *ShardMigrator) isUnsealed(ctx context.Context, sectorID abi.SectorNumber) (bool, error) {
-	// Get the sector seal proof
+func (r *ShardMigrator) reportProgress(p MigrationProgress) {
+	if r.onProgress != nil {
+		r.onProgress(p)
+	}
+}
+
+// isUnsealed reports whether this specific deal's piece is unsealed. A
+// sector that went through partial unseal or a snap-deals upgrade can have a
+// mixture of sealed and unsealed pieces, so the check is scoped to the
+// piece's own offset and size rather than the sector as a whole.
+func (r *ShardMigrator) isUnsealed(ctx context.Context, deal storagemarket.MinerDeal) (bool, error) {
+	sectorID := deal.SectorNumber
+
 	secInfo, err := r.sectorState.StateSectorGetInfo(ctx, r.providerAddr, sectorID, types.EmptyTSK)
 	if err != nil {
 		return false, xerrors.Errorf("failed to get sector %d info: %w", sectorID, err)
 	}
 
+	pieces, err := r.sectorState.StateSectorGetPieces(ctx, r.providerAddr, sectorID, types.EmptyTSK)
+	if err != nil {
+		return false, xerrors.Errorf("failed to get piece manifest for sector %d: %w", sectorID, err)
+	}
+
+	piece, ok := findPiece(pieces, *deal.Ref.PieceCid)
+	if !ok {
+		return false, xerrors.Errorf("piece %s not found in sector %d piece manifest", deal.Ref.PieceCid, sectorID)
+	}
+
 	mid, err := address.IDFromAddress(r.providerAddr)
 	if err != nil {
 		return false, xerrors.Errorf("failed to convert addr %s to ID address: %w", r.providerAddr, err)
@@ -168,15 +258,20 @@ func (r *ShardMigrator) isUnsealed(ctx context.Context, sectorID abi.SectorNumbe
 		ProofType: secInfo.SealProof,
 	}
 
-	// At the time this migration was written all deals in a sector are either
-	// sealed or unsealed. It's not possible for there to be a mixture of
-	// sealed and unsealed deals in a sector.
-	// Therefore the offset and size of the deal in the sector are not
-	// important.
-	isUnsealed, err := r.sectorState.IsUnsealed(ctx, ref, 0, 1)
+	isUnsealed, err := r.sectorState.IsUnsealed(ctx, ref, piece.Offset, piece.Size)
 	if err != nil {
-		return false, xerrors.Errorf("failed to check if sector %d is unsealed: %w", sectorID, err)
+		return false, xerrors.Errorf("failed to check if piece %s (sector %d, offset %d, size %d) is unsealed: %w",
+			deal.Ref.PieceCid, sectorID, piece.Offset, piece.Size, err)
 	}
 
 	return isUnsealed, nil
-}
\ No newline at end of file
+}
+
+func findPiece(pieces []SectorPiece, pieceCid cid.Cid) (SectorPiece, bool) {
+	for _, p := range pieces {
+		if p.PieceCID.Equals(pieceCid) {
+			return p, true
+		}
+	}
+	return SectorPiece{}, false
+}
@@ -0,0 +1,91 @@
+package storageimpl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/filecoin-project/specs-storage/storage"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+)
+
+// mixedSectorState simulates a sector with a fixed piece manifest where
+// individual pieces may be sealed or unsealed independently of one another,
+// e.g. after a partial unseal or a snap-deals upgrade.
+type mixedSectorState struct {
+	pieces          []SectorPiece
+	unsealedOffsets map[storiface.UnpaddedByteIndex]bool
+}
+
+func (m mixedSectorState) StateSectorGetInfo(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) (*miner.SectorOnChainInfo, error) {
+	return &miner.SectorOnChainInfo{}, nil
+}
+
+func (m mixedSectorState) StateSectorGetPieces(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) ([]SectorPiece, error) {
+	return m.pieces, nil
+}
+
+func (m mixedSectorState) IsUnsealed(ctx context.Context, sector storage.SectorRef, offset storiface.UnpaddedByteIndex, size abi.UnpaddedPieceSize) (bool, error) {
+	return m.unsealedOffsets[offset], nil
+}
+
+func pieceCidAt(t *testing.T, i int) cid.Cid {
+	mh, err := multihash.Sum([]byte{byte(i)}, multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func TestIsUnsealedUsesPieceOffsetAndSize(t *testing.T) {
+	sealedPiece := pieceCidAt(t, 0)
+	unsealedPiece := pieceCidAt(t, 1)
+	missingPiece := pieceCidAt(t, 2)
+
+	sectorState := mixedSectorState{
+		pieces: []SectorPiece{
+			{PieceCID: sealedPiece, Offset: 0, Size: 1024},
+			{PieceCID: unsealedPiece, Offset: 1024, Size: 2048},
+		},
+		unsealedOffsets: map[storiface.UnpaddedByteIndex]bool{
+			1024: true,
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		pieceCid     cid.Cid
+		wantUnsealed bool
+		wantErr      bool
+	}{
+		{name: "sealed piece in otherwise-unsealed sector", pieceCid: sealedPiece, wantUnsealed: false},
+		{name: "unsealed piece", pieceCid: unsealedPiece, wantUnsealed: true},
+		{name: "piece not in sector manifest", pieceCid: missingPiece, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			maddr, err := address.NewIDAddress(1000)
+			require.NoError(t, err)
+			r := NewShardMigrator(maddr, nil, nil, sectorState)
+			deal := storagemarket.MinerDeal{
+				Ref: &storagemarket.DataRef{PieceCid: &tc.pieceCid},
+			}
+
+			got, err := r.isUnsealed(context.Background(), deal)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantUnsealed, got)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package storageimpl
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/dagstore"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/extern/sector-storage/storiface"
+	"github.com/filecoin-project/specs-storage/storage"
+
+	mktdagstore "github.com/filecoin-project/go-fil-markets/dagstore"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/impl/providerstates"
+)
+
+type fakeSectorState struct{}
+
+func (fakeSectorState) StateSectorGetInfo(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) (*miner.SectorOnChainInfo, error) {
+	return &miner.SectorOnChainInfo{}, nil
+}
+
+func (fakeSectorState) StateSectorGetPieces(context.Context, address.Address, abi.SectorNumber, types.TipSetKey) ([]SectorPiece, error) {
+	return nil, nil
+}
+
+func (fakeSectorState) IsUnsealed(context.Context, storage.SectorRef, storiface.UnpaddedByteIndex, abi.UnpaddedPieceSize) (bool, error) {
+	return true, nil
+}
+
+// failAfterNDagStore registers the first n shards successfully, then fails
+// every subsequent registration, simulating a migration that crashes
+// partway through.
+type failAfterNDagStore struct {
+	mu         sync.Mutex
+	remaining  int
+	registered map[string]struct{}
+}
+
+func (f *failAfterNDagStore) RegisterShard(ctx context.Context, pieceCid cid.Cid, carPath string, eagerInit bool, resch chan dagstore.ShardResult) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.remaining <= 0 {
+		return xerrors.New("simulated crash")
+	}
+	f.remaining--
+	f.registered[pieceCid.String()] = struct{}{}
+	resch <- dagstore.ShardResult{}
+	return nil
+}
+
+func (f *failAfterNDagStore) LoadShard(context.Context, cid.Cid) (bstore.Blockstore, error) {
+	return nil, nil
+}
+
+func (f *failAfterNDagStore) Close() error { return nil }
+
+func (f *failAfterNDagStore) Blockstore() *mktdagstore.AllBlockstore { return nil }
+
+func (f *failAfterNDagStore) DestroyShard(context.Context, cid.Cid, bool) error { return nil }
+
+func (f *failAfterNDagStore) ListShards(context.Context) ([]cid.Cid, error) { return nil, nil }
+
+func (f *failAfterNDagStore) RecoverShard(context.Context, cid.Cid) error { return nil }
+
+func (f *failAfterNDagStore) FailureCh() <-chan dagstore.ShardResult { return nil }
+
+var _ mktdagstore.DagStoreWrapper = (*failAfterNDagStore)(nil)
+
+func dealWithPiece(t *testing.T, i int) storagemarket.MinerDeal {
+	// Each deal gets a distinct piece CID so the per-deal progress keys
+	// don't collide.
+	mh, err := multihash.Sum([]byte(fmt.Sprintf("piece-%d", i)), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	pieceCid := cid.NewCidV1(cid.Raw, mh)
+	return storagemarket.MinerDeal{
+		Ref: &storagemarket.DataRef{
+			PieceCid: &pieceCid,
+		},
+		State: providerstates.StatesKnownBySealingSubsystem[0],
+	}
+}
+
+func TestShardMigratorResumesAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	deals := make([]storagemarket.MinerDeal, 4)
+	for i := range deals {
+		deals[i] = dealWithPiece(t, i)
+	}
+
+	crashing := &failAfterNDagStore{remaining: 2, registered: map[string]struct{}{}}
+	m := NewShardMigrator(address.TestAddress, ds, crashing, fakeSectorState{})
+	m.concurrency = 1
+
+	// First run crashes partway through: only 2 of 4 deals get registered.
+	_ = m.registerShards(ctx, deals)
+	require.Len(t, crashing.registered, 2)
+
+	// A second run, with an unlimited dagstore, should only need to
+	// register the deals that weren't completed the first time.
+	resumed := &failAfterNDagStore{remaining: len(deals), registered: map[string]struct{}{}}
+	m2 := NewShardMigrator(address.TestAddress, ds, resumed, fakeSectorState{})
+	m2.concurrency = 1
+	require.NoError(t, m2.registerShards(ctx, deals))
+
+	require.Len(t, resumed.registered, 2, "resume should only re-register the deals that weren't already marked done")
+}